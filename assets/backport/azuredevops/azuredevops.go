@@ -0,0 +1,324 @@
+/*
+Copyright 2022 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package azuredevops implements the backport provider.Provider interface
+// for Azure Repos using the Azure DevOps Git API.
+package azuredevops
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gravitational/trace"
+	azuredevops "github.com/microsoft/azure-devops-go-api/azuredevops/v7"
+	"github.com/microsoft/azure-devops-go-api/azuredevops/v7/git"
+	"github.com/microsoft/azure-devops-go-api/azuredevops/v7/webapi"
+
+	"github.com/teleport/assets/backport/provider"
+)
+
+type Client struct {
+	Client git.Client
+	Config
+}
+
+type Config struct {
+	Token string
+	// BaseURL is the organization URL, e.g.
+	// "https://dev.azure.com/gravitational".
+	BaseURL string
+	// Organization is the Azure DevOps project name.
+	Organization string
+	Repository   string
+}
+
+// Check validates config.
+func (c *Config) Check() error {
+	if c.Token == "" {
+		return trace.BadParameter("missing token")
+	}
+	if c.BaseURL == "" {
+		return trace.BadParameter("missing base URL")
+	}
+	if c.Organization == "" {
+		return trace.BadParameter("missing organization")
+	}
+	if c.Repository == "" {
+		return trace.BadParameter("missing repository")
+	}
+	return nil
+}
+
+// New returns a new Azure DevOps client.
+func New(ctx context.Context, c *Config) (*Client, error) {
+	if err := c.Check(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	conn := azuredevops.NewPatConnection(c.BaseURL, c.Token)
+	clt, err := git.NewClient(ctx, conn)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &Client{
+		Client: clt,
+		Config: *c,
+	}, nil
+}
+
+// Backport backports changes from backportBranchName to a new branch based
+// off baseBranchName.
+func (c *Client) Backport(ctx context.Context, baseBranchName, backportBranchName string, commits []string, mainline int) (string, error) {
+	newBranchName := fmt.Sprintf("auto-backport/%s/%s", baseBranchName, backportBranchName)
+	if err := c.CreateBranchFrom(ctx, baseBranchName, newBranchName); err != nil {
+		return "", trace.Wrap(err)
+	}
+	fmt.Printf("Created a new branch: %s.\n", newBranchName)
+
+	if err := c.CherryPick(ctx, newBranchName, commits, mainline); err != nil {
+		return "", trace.Wrap(err)
+	}
+	fmt.Printf("Finished cherry-picking %v commits. \n", len(commits))
+	return newBranchName, nil
+}
+
+// CreateBranchFrom creates a branch from the passed in branch's HEAD.
+func (c *Client) CreateBranchFrom(ctx context.Context, branchFromName string, newBranchName string) error {
+	refs, err := c.Client.GetRefs(ctx, git.GetRefsArgs{
+		RepositoryId: &c.Repository,
+		Project:      &c.Organization,
+		Filter:       stringPtr(fmt.Sprintf("%s%s", branchRefPrefix, branchFromName)),
+	})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if refs == nil || len(refs.Value) == 0 {
+		return trace.NotFound("branch %s not found", branchFromName)
+	}
+	baseObjectID := refs.Value[0].ObjectId
+
+	_, err = c.Client.UpdateRefs(ctx, git.UpdateRefsArgs{
+		RepositoryId: &c.Repository,
+		Project:      &c.Organization,
+		RefUpdates: &[]git.GitRefUpdate{{
+			Name:        stringPtr(fmt.Sprintf("%s%s", branchRefPrefix, newBranchName)),
+			OldObjectId: stringPtr(zeroObjectID),
+			NewObjectId: baseObjectID,
+		}},
+	})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return nil
+}
+
+// CherryPick cherry picks a list of commits, in order, onto a given branch
+// using Azure DevOps's asynchronous cherry-pick operation. Azure DevOps does
+// not expose mainline parent selection for merge commits, so mainline must
+// be 0.
+func (c *Client) CherryPick(ctx context.Context, branchName string, commits []string, mainline int) error {
+	if mainline != 0 {
+		return trace.NotImplemented("cherry-picking a merge commit is not supported on Azure DevOps")
+	}
+	for _, sha := range commits {
+		sha := sha
+		op, err := c.Client.CreateCherryPick(ctx, git.CreateCherryPickArgs{
+			RepositoryId: &c.Repository,
+			Project:      &c.Organization,
+			CherryPickToCreate: &git.GitAsyncRefOperationParameters{
+				Source: &git.GitAsyncRefOperationSource{
+					CommitList: &[]git.GitCommitRef{{CommitId: &sha}},
+				},
+				// branchName already exists (CreateBranchFrom created it), so
+				// target it directly rather than generating a new ref.
+				OntoRefName: stringPtr(fmt.Sprintf("%s%s", branchRefPrefix, branchName)),
+			},
+		})
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		if err := c.waitForCherryPick(ctx, *op.CherryPickId, sha); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// cherryPickPollInterval is how often waitForCherryPick polls the status of
+// an in-flight asynchronous cherry-pick operation.
+const cherryPickPollInterval = 2 * time.Second
+
+// waitForCherryPick polls an asynchronous cherry-pick operation until it
+// leaves the queued/in-progress state, returning an error if it didn't
+// complete successfully.
+func (c *Client) waitForCherryPick(ctx context.Context, cherryPickID int, sha string) error {
+	for {
+		op, err := c.Client.GetCherryPick(ctx, git.GetCherryPickArgs{
+			Project:      &c.Organization,
+			CherryPickId: &cherryPickID,
+		})
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		switch *op.Status {
+		case git.GitAsyncOperationStatusValues.Completed:
+			return nil
+		case git.GitAsyncOperationStatusValues.Queued, git.GitAsyncOperationStatusValues.InProgress:
+			// Not done yet, keep polling below.
+		default:
+			return trace.Errorf("cherry-pick of %s did not complete: %s", sha, *op.Status)
+		}
+		select {
+		case <-ctx.Done():
+			return trace.Wrap(ctx.Err())
+		case <-time.After(cherryPickPollInterval):
+		}
+	}
+}
+
+// CreatePullRequest opens an Azure Repos pull request with the given
+// reviewers, then attaches its labels. Azure Repos has no notion of
+// assignees or milestones on a pull request, so opts.Assignees and
+// opts.MilestoneNumber are ignored. It returns the URL of the created pull
+// request.
+func (c *Client) CreatePullRequest(ctx context.Context, baseBranch string, headBranch string, opts provider.PullRequestOptions) (string, error) {
+	reviewers := make([]git.IdentityRefWithVote, 0, len(opts.Reviewers))
+	for _, username := range opts.Reviewers {
+		reviewers = append(reviewers, git.IdentityRefWithVote{IdentityRef: webapi.IdentityRef{UniqueName: stringPtr(username)}})
+	}
+	pull, err := c.Client.CreatePullRequest(ctx, git.CreatePullRequestArgs{
+		RepositoryId: &c.Repository,
+		Project:      &c.Organization,
+		GitPullRequestToCreate: &git.GitPullRequest{
+			Title:         &opts.Title,
+			Description:   &opts.Body,
+			SourceRefName: stringPtr(fmt.Sprintf("%s%s", branchRefPrefix, headBranch)),
+			TargetRefName: stringPtr(fmt.Sprintf("%s%s", branchRefPrefix, baseBranch)),
+			Reviewers:     &reviewers,
+		},
+	})
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+
+	for _, label := range opts.Labels {
+		label := label
+		_, err := c.Client.CreatePullRequestLabel(ctx, git.CreatePullRequestLabelArgs{
+			RepositoryId:  &c.Repository,
+			Project:       &c.Organization,
+			PullRequestId: pull.PullRequestId,
+			Label:         &webapi.WebApiCreateTagRequestData{Name: &label},
+		})
+		if err != nil {
+			return "", trace.Wrap(err)
+		}
+	}
+	return pullRequestURL(c.BaseURL, c.Organization, c.Repository, *pull.PullRequestId), nil
+}
+
+// pullRequestURL builds the web URL for a pull request, since the Azure
+// DevOps Git API does not return one directly.
+func pullRequestURL(organizationURL, project, repository string, pullRequestID int) string {
+	return fmt.Sprintf("%s/%s/_git/%s/pullrequest/%d", strings.TrimSuffix(organizationURL, "/"), project, repository, pullRequestID)
+}
+
+// CreateConflictPullRequest is not yet implemented for Azure DevOps:
+// CherryPick never returns a *provider.ConflictError here, so this is never
+// called.
+func (c *Client) CreateConflictPullRequest(ctx context.Context, baseBranch, headBranch string, prNumber int, conflict *provider.ConflictError) (string, error) {
+	return "", trace.NotImplemented("conflict reporting is not supported on Azure DevOps yet")
+}
+
+// GetPullRequestMetadata gets the metadata needed to backport the pull
+// request associated with the passed in ID: its commits, title, description,
+// labels, and reviewers. Azure Repos has no notion of assignees or
+// milestones on a pull request, so those fields are left unset.
+func (c *Client) GetPullRequestMetadata(ctx context.Context, number int) (*provider.PullRequestMetadata, error) {
+	pull, err := c.Client.GetPullRequest(ctx, git.GetPullRequestArgs{
+		RepositoryId:  &c.Repository,
+		Project:       &c.Organization,
+		PullRequestId: &number,
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if *pull.Status != git.PullRequestStatusValues.Completed {
+		return nil, trace.Errorf("pull request %v is not completed", number)
+	}
+	if *pull.TargetRefName != fmt.Sprintf("%s%s", branchRefPrefix, masterBranchName) {
+		return nil, trace.Errorf("pull request %v's base is not %s", number, masterBranchName)
+	}
+
+	meta := &provider.PullRequestMetadata{
+		BranchName: (*pull.SourceRefName)[len(branchRefPrefix):],
+		Title:      *pull.Title,
+		Body:       stringOrEmpty(pull.Description),
+	}
+	if pull.Labels != nil {
+		for _, label := range *pull.Labels {
+			meta.Labels = append(meta.Labels, *label.Name)
+		}
+	}
+	if pull.Reviewers != nil {
+		for _, reviewer := range *pull.Reviewers {
+			meta.Reviewers = append(meta.Reviewers, *reviewer.UniqueName)
+		}
+	}
+
+	// Like GitLab's and Bitbucket Server's, Azure Repos' pull request
+	// commits endpoint returns commits newest-first; CherryPick applies
+	// meta.Commits in slice order, so they need to be reversed back to
+	// chronological order.
+	prCommits, err := c.Client.GetPullRequestCommits(ctx, git.GetPullRequestCommitsArgs{
+		RepositoryId:  &c.Repository,
+		Project:       &c.Organization,
+		PullRequestId: &number,
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	commits := *prCommits.Value
+	for i := len(commits) - 1; i >= 0; i-- {
+		meta.Commits = append(meta.Commits, *commits[i].CommitId)
+	}
+	return meta, nil
+}
+
+var _ provider.Provider = (*Client)(nil)
+
+func stringPtr(s string) *string { return &s }
+
+// stringOrEmpty returns *s, or "" if s is nil. The Azure DevOps API leaves
+// fields like Description nil when they were never set.
+func stringOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+const (
+	// masterBranchName is the default branch name.
+	masterBranchName = "master"
+
+	// branchRefPrefix is the prefix Azure DevOps uses for branch refs.
+	branchRefPrefix = "refs/heads/"
+
+	// zeroObjectID is the all-zero git object ID Azure DevOps expects as
+	// the "old" object when creating a brand new ref.
+	zeroObjectID = "0000000000000000000000000000000000000000"
+)
@@ -0,0 +1,223 @@
+/*
+Copyright 2022 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package bitbucket implements the backport provider.Provider interface for
+// Bitbucket Server / Data Center using the REST API's project/repo model.
+package bitbucket
+
+import (
+	"context"
+	"fmt"
+
+	bb "github.com/gfleury/go-bitbucket-v1"
+	"github.com/gravitational/trace"
+
+	"github.com/teleport/assets/backport/provider"
+)
+
+type Client struct {
+	Client *bb.DefaultApiService
+	Config
+}
+
+type Config struct {
+	Token string
+	// BaseURL is the Bitbucket Server base URL, e.g.
+	// "https://bitbucket.example.com". Always required, Bitbucket Server
+	// has no SaaS default.
+	BaseURL string
+	// Organization is the Bitbucket Server project key, e.g. "TELE".
+	Organization string
+	Repository   string
+}
+
+// Check validates config.
+func (c *Config) Check() error {
+	if c.Token == "" {
+		return trace.BadParameter("missing token")
+	}
+	if c.BaseURL == "" {
+		return trace.BadParameter("missing base URL")
+	}
+	if c.Organization == "" {
+		return trace.BadParameter("missing organization")
+	}
+	if c.Repository == "" {
+		return trace.BadParameter("missing repository")
+	}
+	return nil
+}
+
+// New returns a new Bitbucket Server client. go-bitbucket-v1's generated
+// DefaultApiService methods (CherryPick, CreatePullRequest, etc.) take no
+// per-call context, so the context passed in here is the only one that will
+// ever govern those requests; it is not re-derived per call the way the
+// other providers' clients are.
+func New(ctx context.Context, c *Config) (*Client, error) {
+	if err := c.Check(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	bbCtx := context.WithValue(ctx, bb.ContextAccessToken, c.Token)
+	cfg := bb.NewConfiguration(c.BaseURL)
+	clt := bb.NewAPIClient(bbCtx, cfg)
+	return &Client{
+		Client: clt.DefaultApi,
+		Config: *c,
+	}, nil
+}
+
+// Backport backports changes from backportBranchName to a new branch based
+// off baseBranchName.
+func (c *Client) Backport(ctx context.Context, baseBranchName, backportBranchName string, commits []string, mainline int) (string, error) {
+	newBranchName := fmt.Sprintf("auto-backport/%s/%s", baseBranchName, backportBranchName)
+	if err := c.CreateBranchFrom(ctx, baseBranchName, newBranchName); err != nil {
+		return "", trace.Wrap(err)
+	}
+	fmt.Printf("Created a new branch: %s.\n", newBranchName)
+
+	if err := c.CherryPick(ctx, newBranchName, commits, mainline); err != nil {
+		return "", trace.Wrap(err)
+	}
+	fmt.Printf("Finished cherry-picking %v commits. \n", len(commits))
+	return newBranchName, nil
+}
+
+// CreateBranchFrom creates a branch from the passed in branch's HEAD.
+func (c *Client) CreateBranchFrom(ctx context.Context, branchFromName string, newBranchName string) error {
+	_, err := c.Client.CreateBranch(c.Organization, c.Repository, bb.CreateBranchRequest{
+		Name:       newBranchName,
+		StartPoint: branchFromName,
+	})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return nil
+}
+
+// CherryPick cherry picks a list of commits, in order, onto a given branch
+// using Bitbucket Server's cherry-pick endpoint. Bitbucket Server does not
+// expose mainline parent selection for merge commits, so mainline must be 0.
+func (c *Client) CherryPick(ctx context.Context, branchName string, commits []string, mainline int) error {
+	if mainline != 0 {
+		return trace.NotImplemented("cherry-picking a merge commit is not supported on Bitbucket Server")
+	}
+	for _, sha := range commits {
+		_, err := c.Client.CherryPick(c.Organization, c.Repository, sha, bb.CherryPickRequest{
+			ToRef: bb.Ref{ID: fmt.Sprintf("%s%s", branchRefPrefix, branchName)},
+		})
+		if err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// CreatePullRequest opens a Bitbucket Server pull request with the given
+// reviewers. Bitbucket Server has no notion of labels, assignees, or
+// milestones on a pull request, so opts.Labels, opts.Assignees, and
+// opts.MilestoneNumber are ignored. It returns the URL of the created pull
+// request.
+func (c *Client) CreatePullRequest(ctx context.Context, baseBranch string, headBranch string, opts provider.PullRequestOptions) (string, error) {
+	reviewers := make([]bb.UserWithMetadata, 0, len(opts.Reviewers))
+	for _, username := range opts.Reviewers {
+		reviewers = append(reviewers, bb.UserWithMetadata{User: bb.UserWithLinks{Name: username}})
+	}
+	pull, err := c.Client.CreatePullRequest(c.Organization, c.Repository, &bb.PullRequest{
+		Title:       opts.Title,
+		Description: opts.Body,
+		Reviewers:   reviewers,
+		FromRef: bb.PullRequestRef{
+			ID: fmt.Sprintf("%s%s", branchRefPrefix, headBranch),
+			Repository: bb.Repository{
+				Slug:    c.Repository,
+				Project: &bb.Project{Key: c.Organization},
+			},
+		},
+		ToRef: bb.PullRequestRef{
+			ID: fmt.Sprintf("%s%s", branchRefPrefix, baseBranch),
+			Repository: bb.Repository{
+				Slug:    c.Repository,
+				Project: &bb.Project{Key: c.Organization},
+			},
+		},
+	})
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	if len(pull.Links.Self) > 0 {
+		return pull.Links.Self[0].Href, nil
+	}
+	return "", nil
+}
+
+// CreateConflictPullRequest is not yet implemented for Bitbucket Server:
+// CherryPick never returns a *provider.ConflictError here, so this is never
+// called.
+func (c *Client) CreateConflictPullRequest(ctx context.Context, baseBranch, headBranch string, prNumber int, conflict *provider.ConflictError) (string, error) {
+	return "", trace.NotImplemented("conflict reporting is not supported on Bitbucket Server yet")
+}
+
+// GetPullRequestMetadata gets the metadata needed to backport the pull
+// request associated with the passed in ID: its commits, title, description,
+// and reviewers. Bitbucket Server has no notion of labels, assignees, or
+// milestones on a pull request, so those fields are left unset.
+func (c *Client) GetPullRequestMetadata(ctx context.Context, number int) (*provider.PullRequestMetadata, error) {
+	pull, err := c.Client.GetPullRequest(c.Organization, c.Repository, number)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if pull.State != mergedState {
+		return nil, trace.Errorf("pull request %v is not merged", number)
+	}
+	if pull.ToRef.ID != fmt.Sprintf("%s%s", branchRefPrefix, masterBranchName) {
+		return nil, trace.Errorf("pull request %v's base is not %s", number, masterBranchName)
+	}
+
+	meta := &provider.PullRequestMetadata{
+		BranchName: pull.FromRef.ID[len(branchRefPrefix):],
+		Title:      pull.Title,
+		Body:       pull.Description,
+	}
+	for _, reviewer := range pull.Reviewers {
+		meta.Reviewers = append(meta.Reviewers, reviewer.User.Name)
+	}
+
+	// Like GitLab's, Bitbucket Server's pull request commits endpoint
+	// returns commits newest-first; CherryPick applies meta.Commits in
+	// slice order, so they need to be reversed back to chronological order.
+	prCommits, err := c.Client.GetPullRequestCommits(c.Organization, c.Repository, number)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	for i := len(prCommits) - 1; i >= 0; i-- {
+		meta.Commits = append(meta.Commits, prCommits[i].ID)
+	}
+	return meta, nil
+}
+
+var _ provider.Provider = (*Client)(nil)
+
+const (
+	// mergedState is the state a pull request should be in to backport
+	// its changes.
+	mergedState = "MERGED"
+
+	// masterBranchName is the default branch name.
+	masterBranchName = "master"
+
+	// branchRefPrefix is the prefix Bitbucket Server uses for branch refs.
+	branchRefPrefix = "refs/heads/"
+)
@@ -18,18 +18,55 @@ package github
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/gravitational/trace"
+	"github.com/teleport/assets/backport/provider"
 
 	go_github "github.com/google/go-github/v41/github"
 	"golang.org/x/oauth2"
 )
 
+// Client implements provider.Provider for GitHub.
+var _ provider.Provider = (*Client)(nil)
+
 type Client struct {
 	Client *go_github.Client
 	Config
+
+	// commits caches commits fetched by SHA, so that backporting the same
+	// commits onto several target branches concurrently only fetches each
+	// one once.
+	commits commitCache
+}
+
+// commitCache is a concurrency-safe cache of commits by SHA.
+type commitCache struct {
+	mu    sync.Mutex
+	bySHA map[string]*go_github.Commit
+}
+
+// getCommit returns the commit with the given SHA, fetching and caching it
+// on a miss.
+func (c *Client) getCommit(ctx context.Context, sha string) (*go_github.Commit, error) {
+	c.commits.mu.Lock()
+	defer c.commits.mu.Unlock()
+	if c.commits.bySHA == nil {
+		c.commits.bySHA = make(map[string]*go_github.Commit)
+	}
+	if commit, ok := c.commits.bySHA[sha]; ok {
+		return commit, nil
+	}
+	commit, _, err := c.Client.Git.GetCommit(ctx, c.Organization, c.Repository, sha)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	c.commits.bySHA[sha] = commit
+	return commit, nil
 }
 
 type Config struct {
@@ -72,63 +109,188 @@ func (c *Config) Check() error {
 // A new branch is created with the name in the format of
 // auto-backport/[baseBranchName]/[backportBranchName], and
 // cherry-picks commits onto the new branch.
-func (c *Client) Backport(ctx context.Context, baseBranchName, backportBranchName string, commits []string) (string, error) {
+func (c *Client) Backport(ctx context.Context, baseBranchName, backportBranchName string, commits []string, mainline int) (string, error) {
 	newBranchName := fmt.Sprintf("auto-backport/%s/%s", baseBranchName, backportBranchName)
 	// Create a new branch off of the target branch.
-	err := c.createBranchFrom(ctx, baseBranchName, newBranchName)
+	err := c.CreateBranchFrom(ctx, baseBranchName, newBranchName)
 	if err != nil {
 		return "", trace.Wrap(err)
 	}
 	fmt.Printf("Created a new branch: %s.\n", newBranchName)
 
 	// Cherry pick commits.
-	err = c.cherryPickCommitsOnBranch(ctx, newBranchName, commits)
+	err = c.CherryPick(ctx, newBranchName, commits, mainline)
 	if err != nil {
+		var conflict *provider.ConflictError
+		if errors.As(err, &conflict) {
+			// Leave newBranchName in place, commits before the conflicting
+			// one applied, so the caller can open a conflict PR against it.
+			return newBranchName, err
+		}
 		return "", trace.Wrap(err)
 	}
 	fmt.Printf("Finished cherry-picking %v commits. \n", len(commits))
 	return newBranchName, nil
 }
 
-// CreatePullRequest creates a pull request.
-func (c *Client) CreatePullRequest(ctx context.Context, baseBranch string, headBranch string, titleAndBody string) error {
+// CreatePullRequest creates a pull request and then attaches its labels,
+// reviewers, and milestone, since GitHub does not accept them at creation
+// time. Those attachment steps are best-effort: a rejected label, reviewer
+// (e.g. one who is no longer a collaborator), or milestone is logged and
+// skipped rather than failing the whole call, since the pull request itself
+// was already created successfully by that point. It returns the URL of the
+// created pull request.
+func (c *Client) CreatePullRequest(ctx context.Context, baseBranch string, headBranch string, opts provider.PullRequestOptions) (string, error) {
 	newPR := &go_github.NewPullRequest{
-		Title:               go_github.String(titleAndBody),
+		Title:               go_github.String(opts.Title),
 		Head:                go_github.String(headBranch),
 		Base:                go_github.String(baseBranch),
-		Body:                go_github.String(titleAndBody),
+		Body:                go_github.String(opts.Body),
 		MaintainerCanModify: go_github.Bool(true),
 	}
-	_, _, err := c.Client.PullRequests.Create(ctx, c.Organization, c.Repository, newPR)
+	pull, _, err := c.Client.PullRequests.Create(ctx, c.Organization, c.Repository, newPR)
 	if err != nil {
-		return err
+		return "", trace.Wrap(err)
 	}
-	return nil
+
+	if len(opts.Labels) > 0 {
+		_, _, err = c.Client.Issues.AddLabelsToIssue(ctx, c.Organization, c.Repository, pull.GetNumber(), opts.Labels)
+		if err != nil {
+			fmt.Printf("Failed to add labels to %s: %v.\n", pull.GetHTMLURL(), err)
+		}
+	}
+	if len(opts.Reviewers) > 0 {
+		_, _, err = c.Client.PullRequests.RequestReviewers(ctx, c.Organization, c.Repository, pull.GetNumber(), go_github.ReviewersRequest{
+			Reviewers: opts.Reviewers,
+		})
+		if err != nil {
+			fmt.Printf("Failed to request reviewers on %s: %v.\n", pull.GetHTMLURL(), err)
+		}
+	}
+	if len(opts.Assignees) > 0 || opts.MilestoneNumber != 0 {
+		issueRequest := &go_github.IssueRequest{}
+		if len(opts.Assignees) > 0 {
+			issueRequest.Assignees = &opts.Assignees
+		}
+		if opts.MilestoneNumber != 0 {
+			issueRequest.Milestone = &opts.MilestoneNumber
+		}
+		_, _, err = c.Client.Issues.Edit(ctx, c.Organization, c.Repository, pull.GetNumber(), issueRequest)
+		if err != nil {
+			fmt.Printf("Failed to set assignees/milestone on %s: %v.\n", pull.GetHTMLURL(), err)
+		}
+	}
+	return pull.GetHTMLURL(), nil
+}
+
+// CreateConflictPullRequest opens a draft pull request reporting a
+// cherry-pick conflict and labels it "conflict", so a maintainer can pull
+// down headBranch and resolve it locally instead of the backport being
+// redone from scratch. It returns the URL of the created pull request.
+func (c *Client) CreateConflictPullRequest(ctx context.Context, baseBranch, headBranch string, prNumber int, conflict *provider.ConflictError) (string, error) {
+	title := fmt.Sprintf("Backport #%d to %s (CONFLICTS)", prNumber, baseBranch)
+	newPR := &go_github.NewPullRequest{
+		Title:               go_github.String(title),
+		Head:                go_github.String(headBranch),
+		Base:                go_github.String(baseBranch),
+		Body:                go_github.String(conflictPullRequestBody(baseBranch, headBranch, conflict)),
+		Draft:               go_github.Bool(true),
+		MaintainerCanModify: go_github.Bool(true),
+	}
+	pull, _, err := c.Client.PullRequests.Create(ctx, c.Organization, c.Repository, newPR)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+
+	_, _, err = c.Client.Issues.AddLabelsToIssue(ctx, c.Organization, c.Repository, pull.GetNumber(), []string{conflictLabel})
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	return pull.GetHTMLURL(), nil
 }
 
-// GetPullRequestMetadata gets the commit shas, title, and body for a pull request
-// associated with the passed in branch name.
-func (c *Client) GetPullRequestMetadata(ctx context.Context, number int) (commits []string, branchName string, err error) {
+// conflictPullRequestBody renders the body of a conflict pull request: the
+// SHA that failed to cherry-pick cleanly, the files that commit touched, and
+// a suggested command sequence to resolve the conflict locally.
+func conflictPullRequestBody(baseBranch, headBranch string, conflict *provider.ConflictError) string {
+	var files strings.Builder
+	for _, file := range conflict.Files {
+		fmt.Fprintf(&files, "- `%s`\n", file)
+	}
+	return fmt.Sprintf(`This backport hit a conflict cherry-picking %s onto %s.
+
+Commits up to, but not including, %s were applied to this branch successfully.
+
+Files touched by the failing commit (not all of these necessarily conflict):
+%s
+To resolve locally:
+
+	git fetch origin %s
+	git checkout %s
+	git cherry-pick %s
+	# resolve conflicts, then:
+	git add <resolved files>
+	git cherry-pick --continue
+	git push origin %s
+`, conflict.SHA, baseBranch, conflict.SHA, files.String(), headBranch, headBranch, conflict.SHA, headBranch)
+}
+
+// GetPullRequestMetadata gets the metadata needed to backport the pull
+// request associated with the passed in number: its commits (or, if it was
+// merged with a merge commit, that single merge SHA and a mainline hint, so
+// the backport PR mirrors the original merge shape), title, body, labels,
+// assignees, requested reviewers, and milestone.
+func (c *Client) GetPullRequestMetadata(ctx context.Context, number int) (*provider.PullRequestMetadata, error) {
 	pull, _, err := c.Client.PullRequests.Get(ctx, c.Organization, c.Repository, number)
 	if err != nil {
-		return nil, "", trace.Wrap(err)
+		return nil, trace.Wrap(err)
 	}
 	if pull.GetState() != backportPRState {
-		return nil, "", trace.Errorf("pull request %v is not closed", number)
+		return nil, trace.Errorf("pull request %v is not closed", number)
 	}
 	if strings.TrimPrefix(pull.GetBase().GetRef(), branchRefPrefix) != masterBranchName {
-		return nil, "", trace.Errorf("pull request %v's base is not master", number)
+		return nil, trace.Errorf("pull request %v's base is not master", number)
 	}
 
-	commits, err = c.getPullRequestCommits(ctx, pull.GetNumber())
+	meta := &provider.PullRequestMetadata{
+		BranchName:      strings.TrimPrefix(pull.GetHead().GetRef(), branchRefPrefix),
+		Title:           pull.GetTitle(),
+		Body:            pull.GetBody(),
+		MilestoneNumber: pull.GetMilestone().GetNumber(),
+	}
+	for _, label := range pull.Labels {
+		meta.Labels = append(meta.Labels, label.GetName())
+	}
+	for _, assignee := range pull.Assignees {
+		meta.Assignees = append(meta.Assignees, assignee.GetLogin())
+	}
+	for _, reviewer := range pull.RequestedReviewers {
+		meta.Reviewers = append(meta.Reviewers, reviewer.GetLogin())
+	}
+
+	if mergeSHA := pull.GetMergeCommitSHA(); mergeSHA != "" {
+		mergeCommit, _, err := c.Client.Git.GetCommit(ctx, c.Organization, c.Repository, mergeSHA)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if len(mergeCommit.Parents) > 1 {
+			meta.Commits = []string{mergeSHA}
+			meta.Mainline = defaultMainline
+			return meta, nil
+		}
+	}
+
+	meta.Commits, err = c.getPullRequestCommits(ctx, pull.GetNumber())
 	if err != nil {
-		return nil, "", trace.Wrap(err)
+		return nil, trace.Wrap(err)
 	}
-	return commits, strings.TrimPrefix(pull.GetHead().GetRef(), branchRefPrefix), nil
+	return meta, nil
 }
 
-// cherryPickCommitsOnBranch cherry picks a list of commits on a given branch.
-func (c *Client) cherryPickCommitsOnBranch(ctx context.Context, branchName string, commits []string) error {
+// CherryPick cherry picks a list of commits, in order, onto a given branch.
+// mainline selects which parent of a merge commit to diff against, matching
+// `git cherry-pick -m`; pass 0 when none of commits is a merge commit.
+func (c *Client) CherryPick(ctx context.Context, branchName string, commits []string, mainline int) error {
 	branch, _, err := c.Client.Repositories.GetBranch(ctx, c.Organization, c.Repository, branchName, true)
 	if err != nil {
 		return trace.Wrap(err)
@@ -143,12 +305,18 @@ func (c *Client) cherryPickCommitsOnBranch(ctx context.Context, branchName strin
 	}
 
 	for i := 0; i < len(commits); i++ {
-		cherryCommit, _, err := c.Client.Git.GetCommit(ctx, c.Organization, c.Repository, commits[i])
+		cherryCommit, err := c.getCommit(ctx, commits[i])
 		if err != nil {
 			return trace.Wrap(err)
 		}
-		tree, sha, err := c.cherryPickCommit(ctx, branchName, cherryCommit, headCommit)
+		tree, sha, err := c.cherryPickCommit(ctx, branchName, cherryCommit, headCommit, mainline)
 		if err != nil {
+			var conflict *provider.ConflictError
+			if errors.As(err, &conflict) {
+				// Leave the branch and the commits already applied to it in
+				// place so the conflict can be resolved locally.
+				return err
+			}
 			defer func() {
 				refName := fmt.Sprintf("%s%s", branchRefPrefix, branchName)
 				c.Client.Git.DeleteRef(ctx, c.Organization, c.Repository, refName)
@@ -161,12 +329,23 @@ func (c *Client) cherryPickCommitsOnBranch(ctx context.Context, branchName strin
 	return nil
 }
 
-// cherryPickCommit cherry picks a single commit on a branch.
-func (c *Client) cherryPickCommit(ctx context.Context, branchName string, cherryCommit, headBranchCommit *go_github.Commit) (*go_github.Tree, string, error) {
-	if len(cherryCommit.Parents) != 1 {
-		return nil, "", trace.BadParameter("merge commits are not supported")
+// cherryPickCommit cherry picks a single commit on a branch. mainline is the
+// 1-indexed parent to treat as the commit's "mainline" when cherryCommit is a
+// merge commit, matching `git cherry-pick -m`; pass 0 for ordinary,
+// single-parent commits.
+func (c *Client) cherryPickCommit(ctx context.Context, branchName string, cherryCommit, headBranchCommit *go_github.Commit, mainline int) (*go_github.Tree, string, error) {
+	var cherryParent *go_github.Commit
+	switch {
+	case mainline == 0:
+		if len(cherryCommit.Parents) != 1 {
+			return nil, "", trace.BadParameter("merge commits require a mainline parent, pass -m")
+		}
+		cherryParent = cherryCommit.Parents[0]
+	case mainline > 0 && mainline <= len(cherryCommit.Parents):
+		cherryParent = cherryCommit.Parents[mainline-1]
+	default:
+		return nil, "", trace.BadParameter("mainline %d is out of range for commit %s with %d parents", mainline, cherryCommit.GetSHA(), len(cherryCommit.Parents))
 	}
-	cherryParent := cherryCommit.Parents[0]
 	// Temporarily set the parent of the branch HEAD to the parent of the commit
 	// to cherry-pick so they are siblings.
 	err := c.createSiblingCommit(ctx, branchName, headBranchCommit, cherryParent)
@@ -178,8 +357,23 @@ func (c *Client) cherryPickCommit(ctx context.Context, branchName string, cherry
 	// being merged onto matches the parent of the cherry pick commit, and merges a tree of size 1.
 	// The merge commit will contain the delta between the file tree in target branch and the
 	// commit to cherry-pick.
-	merge, err := c.merge(ctx, branchName, cherryCommit.GetSHA())
+	merge, resp, err := c.merge(ctx, branchName, cherryCommit.GetSHA())
 	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusConflict {
+			files, fileErr := c.getConflictingFiles(ctx, cherryParent.GetSHA(), cherryCommit.GetSHA())
+			if fileErr != nil {
+				return nil, "", trace.Wrap(fileErr)
+			}
+			// createSiblingCommit above already moved branchName's ref to a
+			// throwaway commit whose ancestry is headBranchCommit's *parent*,
+			// not headBranchCommit itself. Restore it to the last cleanly
+			// applied commit so the branch left behind for the conflict PR
+			// only diffs the commits actually cherry-picked onto it.
+			if resetErr := c.updateRef(ctx, branchName, headBranchCommit.GetSHA()); resetErr != nil {
+				return nil, "", trace.Wrap(resetErr)
+			}
+			return nil, "", &provider.ConflictError{SHA: cherryCommit.GetSHA(), Files: files}
+		}
 		return nil, "", trace.Wrap(err)
 	}
 	mergeTree := merge.GetTree()
@@ -206,17 +400,22 @@ func (c *Client) cherryPickCommit(ctx context.Context, branchName string, cherry
 	// Overwrite the merge commit and its parent on the branch by the newly created commit.
 	// The result will be equivalent to what would have happened with a fast-forward merge.
 	sha := commit.GetSHA()
+	if err := c.updateRef(ctx, branchName, sha); err != nil {
+		return nil, "", trace.Wrap(err)
+	}
+	return mergeTree, sha, nil
+}
+
+// updateRef force-updates branchName's ref to point at sha.
+func (c *Client) updateRef(ctx context.Context, branchName, sha string) error {
 	refName := fmt.Sprintf("%s%s", branchRefPrefix, branchName)
-	_, _, err = c.Client.Git.UpdateRef(ctx, c.Organization, c.Repository, &go_github.Reference{
+	_, _, err := c.Client.Git.UpdateRef(ctx, c.Organization, c.Repository, &go_github.Reference{
 		Ref: go_github.String(refName),
 		Object: &go_github.GitObject{
 			SHA: go_github.String(sha),
 		},
 	}, true)
-	if err != nil {
-		return nil, "", trace.Wrap(err)
-	}
-	return mergeTree, sha, nil
+	return trace.Wrap(err)
 }
 
 // createSiblingCommit creates a commit with the passed in commit's tree and parent
@@ -235,23 +434,11 @@ func (c *Client) createSiblingCommit(ctx context.Context, branchName string, bra
 	if err != nil {
 		return trace.Wrap(err)
 	}
-	sha := commit.GetSHA()
-
-	refName := fmt.Sprintf("%s%s", branchRefPrefix, branchName)
-	_, _, err = c.Client.Git.UpdateRef(ctx, c.Organization, c.Repository, &go_github.Reference{
-		Ref: go_github.String(refName),
-		Object: &go_github.GitObject{
-			SHA: go_github.String(sha),
-		},
-	}, true)
-	if err != nil {
-		return trace.Wrap(err)
-	}
-	return nil
+	return trace.Wrap(c.updateRef(ctx, branchName, commit.GetSHA()))
 }
 
-// createBranchFrom creates a branch from the passed in branch's HEAD.
-func (c *Client) createBranchFrom(ctx context.Context, branchFromName string, newBranchName string) error {
+// CreateBranchFrom creates a branch from the passed in branch's HEAD.
+func (c *Client) CreateBranchFrom(ctx context.Context, branchFromName string, newBranchName string) error {
 	baseBranch, _, err := c.Client.Repositories.GetBranch(ctx, c.Organization, c.Repository, branchFromName, true)
 	if err != nil {
 		return trace.Wrap(err)
@@ -272,23 +459,41 @@ func (c *Client) createBranchFrom(ctx context.Context, branchFromName string, ne
 	return nil
 }
 
-// merge merges a branch.
-func (c *Client) merge(ctx context.Context, base string, headCommitSHA string) (*go_github.Commit, error) {
-	merge, _, err := c.Client.Repositories.Merge(ctx, c.Organization, c.Repository, &go_github.RepositoryMergeRequest{
+// merge merges a branch. The returned response is non-nil whenever the
+// underlying API call completed, even on error, so callers can inspect its
+// status code (e.g. to detect a 409 conflict).
+func (c *Client) merge(ctx context.Context, base string, headCommitSHA string) (*go_github.Commit, *go_github.Response, error) {
+	merge, resp, err := c.Client.Repositories.Merge(ctx, c.Organization, c.Repository, &go_github.RepositoryMergeRequest{
 		Base: go_github.String(base),
 		Head: go_github.String(headCommitSHA),
 	})
 	if err != nil {
-		return nil, trace.Wrap(err)
+		return nil, resp, trace.Wrap(err)
 	}
 	mergeCommit, _, err := c.Client.Git.GetCommit(ctx,
 		c.Organization,
 		c.Repository,
 		merge.GetSHA())
+	if err != nil {
+		return nil, resp, trace.Wrap(err)
+	}
+	return mergeCommit, resp, nil
+}
+
+// getConflictingFiles returns the paths that changed between base and head.
+// This is every file the failing commit touched, not only the ones that
+// actually collided, since the GitHub API used here (CompareCommits) has no
+// notion of which of those paths conflict; callers must label it accordingly.
+func (c *Client) getConflictingFiles(ctx context.Context, base, head string) ([]string, error) {
+	comparison, _, err := c.Client.Repositories.CompareCommits(ctx, c.Organization, c.Repository, base, head)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
-	return mergeCommit, nil
+	var files []string
+	for _, file := range comparison.Files {
+		files = append(files, file.GetFilename())
+	}
+	return files, nil
 }
 
 func (c *Client) getPullRequestCommits(ctx context.Context, number int) ([]string, error) {
@@ -333,4 +538,12 @@ const (
 	// branchRefPrefix is the prefix for a reference that is
 	// pointing to a branch.
 	branchRefPrefix = "refs/heads/"
+
+	// defaultMainline is the mainline parent index used when cherry-picking
+	// a merge commit, matching the default of `git cherry-pick -m`.
+	defaultMainline = 1
+
+	// conflictLabel is applied to pull requests opened to report a
+	// cherry-pick conflict.
+	conflictLabel = "conflict"
 )
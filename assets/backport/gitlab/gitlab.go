@@ -0,0 +1,253 @@
+/*
+Copyright 2022 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package gitlab implements the backport provider.Provider interface for
+// GitLab (SaaS or self-managed) using merge requests.
+package gitlab
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gravitational/trace"
+	go_gitlab "github.com/xanzy/go-gitlab"
+
+	"github.com/teleport/assets/backport/provider"
+)
+
+type Client struct {
+	Client *go_gitlab.Client
+	Config
+}
+
+type Config struct {
+	Token string
+	// BaseURL is the API base URL for self-managed GitLab instances, e.g.
+	// "https://gitlab.example.com/". Empty means gitlab.com.
+	BaseURL string
+	// Organization is the GitLab namespace/group the project lives under.
+	Organization string
+	Repository   string
+}
+
+// Check validates config.
+func (c *Config) Check() error {
+	if c.Token == "" {
+		return trace.BadParameter("missing token")
+	}
+	if c.Organization == "" {
+		return trace.BadParameter("missing organization")
+	}
+	if c.Repository == "" {
+		return trace.BadParameter("missing repository")
+	}
+	return nil
+}
+
+// New returns a new GitLab client.
+func New(ctx context.Context, c *Config) (*Client, error) {
+	if err := c.Check(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	var opts []go_gitlab.ClientOptionFunc
+	if c.BaseURL != "" {
+		opts = append(opts, go_gitlab.WithBaseURL(c.BaseURL))
+	}
+	clt, err := go_gitlab.NewClient(c.Token, opts...)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &Client{
+		Client: clt,
+		Config: *c,
+	}, nil
+}
+
+// projectPath is the "namespace/project" identifier the GitLab API expects.
+func (c *Client) projectPath() string {
+	return fmt.Sprintf("%s/%s", c.Organization, c.Repository)
+}
+
+// Backport backports changes from backportBranchName to a new branch based
+// off baseBranchName.
+func (c *Client) Backport(ctx context.Context, baseBranchName, backportBranchName string, commits []string, mainline int) (string, error) {
+	newBranchName := fmt.Sprintf("auto-backport/%s/%s", baseBranchName, backportBranchName)
+	if err := c.CreateBranchFrom(ctx, baseBranchName, newBranchName); err != nil {
+		return "", trace.Wrap(err)
+	}
+	fmt.Printf("Created a new branch: %s.\n", newBranchName)
+
+	if err := c.CherryPick(ctx, newBranchName, commits, mainline); err != nil {
+		return "", trace.Wrap(err)
+	}
+	fmt.Printf("Finished cherry-picking %v commits. \n", len(commits))
+	return newBranchName, nil
+}
+
+// CreateBranchFrom creates a branch from the passed in branch's HEAD.
+func (c *Client) CreateBranchFrom(ctx context.Context, branchFromName string, newBranchName string) error {
+	_, _, err := c.Client.Branches.CreateBranch(c.projectPath(), &go_gitlab.CreateBranchOptions{
+		Branch: go_gitlab.String(newBranchName),
+		Ref:    go_gitlab.String(branchFromName),
+	}, go_gitlab.WithContext(ctx))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return nil
+}
+
+// CherryPick cherry picks a list of commits, in order, onto a given branch
+// using GitLab's server-side cherry-pick endpoint. GitLab does not expose
+// mainline parent selection for merge commits, so mainline must be 0.
+func (c *Client) CherryPick(ctx context.Context, branchName string, commits []string, mainline int) error {
+	if mainline != 0 {
+		return trace.NotImplemented("cherry-picking a merge commit is not supported on GitLab")
+	}
+	for _, sha := range commits {
+		_, _, err := c.Client.Commits.CherryPickCommit(c.projectPath(), sha, &go_gitlab.CherryPickCommitOptions{
+			Branch: go_gitlab.String(branchName),
+		}, go_gitlab.WithContext(ctx))
+		if err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// CreatePullRequest opens a GitLab merge request with its labels and then
+// attaches its assignees, reviewers, and milestone with a follow-up update. It returns the URL of the created merge
+// request.
+func (c *Client) CreatePullRequest(ctx context.Context, baseBranch string, headBranch string, opts provider.PullRequestOptions) (string, error) {
+	mr, _, err := c.Client.MergeRequests.CreateMergeRequest(c.projectPath(), &go_gitlab.CreateMergeRequestOptions{
+		Title:        go_gitlab.String(opts.Title),
+		Description:  go_gitlab.String(opts.Body),
+		SourceBranch: go_gitlab.String(headBranch),
+		TargetBranch: go_gitlab.String(baseBranch),
+		Labels:       (*go_gitlab.Labels)(&opts.Labels),
+	}, go_gitlab.WithContext(ctx))
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+
+	if len(opts.Reviewers) > 0 || len(opts.Assignees) > 0 || opts.MilestoneNumber != 0 {
+		updateOpts := &go_gitlab.UpdateMergeRequestOptions{}
+		if len(opts.Reviewers) > 0 {
+			reviewerIDs, err := c.usernamesToIDs(opts.Reviewers)
+			if err != nil {
+				return "", trace.Wrap(err)
+			}
+			updateOpts.ReviewerIDs = &reviewerIDs
+		}
+		if len(opts.Assignees) > 0 {
+			assigneeIDs, err := c.usernamesToIDs(opts.Assignees)
+			if err != nil {
+				return "", trace.Wrap(err)
+			}
+			updateOpts.AssigneeIDs = &assigneeIDs
+		}
+		if opts.MilestoneNumber != 0 {
+			updateOpts.MilestoneID = go_gitlab.Int(opts.MilestoneNumber)
+		}
+		_, _, err = c.Client.MergeRequests.UpdateMergeRequest(c.projectPath(), mr.IID, updateOpts, go_gitlab.WithContext(ctx))
+		if err != nil {
+			return "", trace.Wrap(err)
+		}
+	}
+	return mr.WebURL, nil
+}
+
+// usernamesToIDs resolves GitLab usernames to the numeric user IDs the
+// merge request update endpoints require.
+func (c *Client) usernamesToIDs(usernames []string) ([]int, error) {
+	ids := make([]int, 0, len(usernames))
+	for _, username := range usernames {
+		users, _, err := c.Client.Users.ListUsers(&go_gitlab.ListUsersOptions{Username: go_gitlab.String(username)})
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if len(users) == 0 {
+			return nil, trace.NotFound("no GitLab user found for username %q", username)
+		}
+		ids = append(ids, users[0].ID)
+	}
+	return ids, nil
+}
+
+// CreateConflictPullRequest is not yet implemented for GitLab: CherryPick
+// never returns a *provider.ConflictError here, so this is never called.
+func (c *Client) CreateConflictPullRequest(ctx context.Context, baseBranch, headBranch string, prNumber int, conflict *provider.ConflictError) (string, error) {
+	return "", trace.NotImplemented("conflict reporting is not supported on GitLab yet")
+}
+
+// GetPullRequestMetadata gets the metadata needed to backport the merge
+// request associated with the passed in IID: its commits, title,
+// description, labels, assignees, requested reviewers, and milestone.
+func (c *Client) GetPullRequestMetadata(ctx context.Context, number int) (*provider.PullRequestMetadata, error) {
+	mr, _, err := c.Client.MergeRequests.GetMergeRequest(c.projectPath(), number, nil, go_gitlab.WithContext(ctx))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if mr.State != mergedState {
+		return nil, trace.Errorf("merge request %v is not merged", number)
+	}
+	if mr.TargetBranch != masterBranchName {
+		return nil, trace.Errorf("merge request %v's target is not %s", number, masterBranchName)
+	}
+
+	meta := &provider.PullRequestMetadata{
+		BranchName: strings.TrimPrefix(mr.SourceBranch, branchRefPrefix),
+		Title:      mr.Title,
+		Body:       mr.Description,
+		Labels:     []string(mr.Labels),
+	}
+	if mr.Milestone != nil {
+		meta.MilestoneNumber = mr.Milestone.ID
+	}
+	for _, assignee := range mr.Assignees {
+		meta.Assignees = append(meta.Assignees, assignee.Username)
+	}
+	for _, reviewer := range mr.Reviewers {
+		meta.Reviewers = append(meta.Reviewers, reviewer.Username)
+	}
+
+	// GetMergeRequestCommits returns commits newest-first; CherryPick applies
+	// meta.Commits in slice order, so they need to be reversed back to
+	// chronological order here.
+	mrCommits, _, err := c.Client.MergeRequests.GetMergeRequestCommits(c.projectPath(), number, nil, go_gitlab.WithContext(ctx))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	for i := len(mrCommits) - 1; i >= 0; i-- {
+		meta.Commits = append(meta.Commits, mrCommits[i].ID)
+	}
+	return meta, nil
+}
+
+var _ provider.Provider = (*Client)(nil)
+
+const (
+	// mergedState is the state a merge request should be in to backport
+	// its changes.
+	mergedState = "merged"
+
+	// masterBranchName is the default branch name.
+	masterBranchName = "master"
+
+	// branchRefPrefix is the prefix GitLab sometimes includes on branch
+	// names returned from the API.
+	branchRefPrefix = "refs/heads/"
+)
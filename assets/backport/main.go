@@ -18,26 +18,50 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
-	"path/filepath"
+	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
 	"time"
 
 	"github.com/gravitational/trace"
-	"github.com/teleport/assets/backport/github"
-	"gopkg.in/yaml.v2"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/teleport/assets/backport/provider"
+	"github.com/teleport/assets/backport/tokensource"
 )
 
 var (
-	to    = flag.String("to", "", "List of comma-separated branch names to backport to.\n Ex: branch/v6,branch/v7\n")
-	pr    = flag.Int("pr", 0, "Pull request with changes to backport.")
-	repo  = flag.String("repo", "teleport", "Name of the repository to open up pull requests in.")
-	owner = flag.String("owner", "gravitational", "Name of the repository's owner.")
+	to           = flag.String("to", "", "List of comma-separated branch names to backport to.\n Ex: branch/v6,branch/v7\n")
+	pr           = flag.Int("pr", 0, "Pull request with changes to backport.")
+	repo         = flag.String("repo", "teleport", "Name of the repository to open up pull requests in.")
+	owner        = flag.String("owner", "gravitational", "Name of the repository's owner.")
+	providerName = flag.String("provider", "", "Git forge to backport against: github, gitlab, bitbucket-server, or azuredevops.\n Detected from the \"origin\" remote URL if not set.\n")
+	baseURL      = flag.String("base-url", "", "API base URL. Required for bitbucket-server and azuredevops, optional self-hosted override for gitlab, not used for github.\n")
+	parallel     = flag.Int("parallel", 4, "Maximum number of target branches to backport to at once.\n")
+)
+
+// backportResult is the outcome of backporting to a single target branch,
+// emitted as a line of JSON as soon as it's known and collected into the
+// final summary table.
+type backportResult struct {
+	Branch string `json:"branch"`
+	Status string `json:"status"`
+	PRURL  string `json:"pr_url,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+const (
+	statusSuccess  = "success"
+	statusConflict = "conflict"
+	statusError    = "error"
 )
 
 func main() {
@@ -49,8 +73,19 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Getting the Github token from ~/.config/gh/hosts.yml
-	token, err := getGithubToken()
+	name := provider.Name(*providerName)
+	if name == "" {
+		remoteURL, err := originRemoteURL()
+		if err != nil {
+			log.Fatal(err)
+		}
+		name, err = provider.DetectName(remoteURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	token, err := getToken(name)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -61,8 +96,9 @@ func main() {
 		log.Fatal(err)
 	}
 
-	clt, err := github.New(ctx, &github.Config{
+	clt, err := provider.New(ctx, name, &provider.Config{
 		Token:        token,
+		BaseURL:      *baseURL,
 		Repository:   *repo,
 		Organization: *owner,
 	})
@@ -70,67 +106,152 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Getting a PR from the branch name to later fill out new pull requests
-	// with the original title and body.
-	commits, branchName, err := clt.GetPullRequestMetadata(ctx, *pr)
+	// Getting the original pull request's metadata once, so it's fetched a
+	// single time and shared across every target branch backported to
+	// below, instead of being re-fetched per branch.
+	meta, err := clt.GetPullRequestMetadata(ctx, *pr)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	for _, targetBranch := range backportBranches {
-		// New branches will be in the format:
-		// auto-backport/[release branch name]/[original branch name]
-		newBranchName, err := clt.Backport(ctx, targetBranch, branchName, commits)
-		if err != nil {
-			log.Fatal(err)
-		}
-		fmt.Printf("Backported commits to branch %s.\n", newBranchName)
+	results := backportAll(ctx, clt, backportBranches, meta)
+	printSummary(results)
 
-		// Create the pull request.
-		err = clt.CreatePullRequest(ctx, targetBranch, newBranchName, generateTitleAndBody(*pr, targetBranch))
-		if err != nil {
-			log.Fatal(err)
+	for _, result := range results {
+		if result.Status == statusError {
+			os.Exit(1)
 		}
-		fmt.Printf("Pull request created for branch %s.\n", newBranchName)
 	}
-	fmt.Println("Backporting complete.")
 }
 
-type Config struct {
-	Host Host `yaml:"github.com"`
-}
+// backportAll backports meta onto every branch in backportBranches
+// concurrently, bounded by --parallel. It never aborts the run because one
+// branch failed: every branch's outcome is collected and returned, and also
+// printed as a line of JSON as soon as it's known.
+func backportAll(ctx context.Context, clt provider.Provider, backportBranches []string, meta *provider.PullRequestMetadata) []backportResult {
+	var (
+		mu      sync.Mutex
+		results = make([]backportResult, len(backportBranches))
+		encoder = json.NewEncoder(os.Stdout)
+	)
+	// Seed every result as an error before any goroutine runs, so a result
+	// that is never overwritten reads as a failure instead of a blank,
+	// "successful"-looking zero value. A branch whose turn under --parallel
+	// comes after the context has timed out still runs, and reports the
+	// context error as its own result.
+	for i, targetBranch := range backportBranches {
+		results[i] = backportResult{Branch: targetBranch, Status: statusError, Error: "did not complete"}
+	}
 
-type Host struct {
-	Token string `yaml:"oauth_token"`
-}
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(*parallel)
 
-// githubConfigPath is the default config path
-// for the Github CLI tool.
-const githubConfigPath = ".config/gh/hosts.yml"
+	for i, targetBranch := range backportBranches {
+		i, targetBranch := i, targetBranch
+		group.Go(func() error {
+			result := backportOne(groupCtx, clt, targetBranch, meta)
 
-// getGithubToken gets the Github auth token from 
-// the Github CLI config.
-func getGithubToken() (string, error) {
-	dirname, err := os.UserHomeDir()
+			mu.Lock()
+			results[i] = result
+			encoder.Encode(result)
+			mu.Unlock()
+			return nil
+		})
+	}
+	// Every goroutine above reports its own outcome in results and returns
+	// nil, so Wait returns only after every branch has run, and returns nil.
+	if err := group.Wait(); err != nil {
+		log.Printf("backport run did not complete: %v", err)
+	}
+	return results
+}
+
+// backportOne backports meta onto a single target branch and opens the
+// resulting (or conflict) pull request, translating any error into a
+// backportResult instead of returning it.
+func backportOne(ctx context.Context, clt provider.Provider, targetBranch string, meta *provider.PullRequestMetadata) backportResult {
+	// New branches will be in the format:
+	// auto-backport/[release branch name]/[original branch name]
+	newBranchName, err := clt.Backport(ctx, targetBranch, meta.BranchName, meta.Commits, meta.Mainline)
 	if err != nil {
-		log.Fatal(err)
+		var conflict *provider.ConflictError
+		if errors.As(err, &conflict) {
+			prURL, prErr := clt.CreateConflictPullRequest(ctx, targetBranch, newBranchName, *pr, conflict)
+			if prErr != nil {
+				return backportResult{Branch: targetBranch, Status: statusError, Error: prErr.Error()}
+			}
+			return backportResult{Branch: targetBranch, Status: statusConflict, PRURL: prURL}
+		}
+		return backportResult{Branch: targetBranch, Status: statusError, Error: err.Error()}
 	}
-	ghConfigPath := filepath.Join(dirname, githubConfigPath)
-	yamlFile, err := ioutil.ReadFile(ghConfigPath)
+
+	prURL, err := clt.CreatePullRequest(ctx, targetBranch, newBranchName, pullRequestOptions(*pr, targetBranch, meta))
 	if err != nil {
-		return "", trace.Wrap(err)
+		return backportResult{Branch: targetBranch, Status: statusError, Error: err.Error()}
+	}
+	return backportResult{Branch: targetBranch, Status: statusSuccess, PRURL: prURL}
+}
+
+// printSummary prints a table of one row per target branch, summarizing the
+// outcome of backportAll.
+func printSummary(results []backportResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "BRANCH\tSTATUS\tPULL REQUEST")
+	for _, result := range results {
+		info := result.PRURL
+		if info == "" {
+			info = result.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", result.Branch, result.Status, info)
+	}
+	w.Flush()
+}
+
+// getToken resolves the API token for the given forge, trying (in order)
+// the forge's own CLI config (GitHub and GitLab only), an environment
+// variable, and the system keyring.
+func getToken(name provider.Name) (string, error) {
+	switch name {
+	case provider.GitHub:
+		return tokensource.Resolve(
+			tokensource.GHCLI{Host: "github.com"},
+			tokensource.Env{Var: "GITHUB_TOKEN"},
+			tokensource.Keyring{Service: keyringService, User: "github.com"},
+		)
+	case provider.GitLab:
+		return tokensource.Resolve(
+			tokensource.GlabCLI{Host: "gitlab.com"},
+			tokensource.Env{Var: "GITLAB_TOKEN"},
+			tokensource.Keyring{Service: keyringService, User: "gitlab.com"},
+		)
+	case provider.BitbucketServer:
+		return tokensource.Resolve(
+			tokensource.Env{Var: "BITBUCKET_TOKEN"},
+			tokensource.Keyring{Service: keyringService, User: "bitbucket-server"},
+		)
+	case provider.AzureDevOps:
+		return tokensource.Resolve(
+			tokensource.Env{Var: "AZURE_DEVOPS_TOKEN"},
+			tokensource.Keyring{Service: keyringService, User: "azuredevops"},
+		)
+	default:
+		return "", trace.BadParameter("unsupported provider %q", name)
 	}
+}
 
-	var config *Config = new(Config)
+// keyringService is the service name backport credentials are stored under
+// in the system keyring.
+const keyringService = "teleport-backport"
 
-	err = yaml.Unmarshal(yamlFile, config)
+// originRemoteURL returns the URL of the repository's "origin" remote, used
+// to detect which forge is being backported against when --provider is not
+// set.
+func originRemoteURL() (string, error) {
+	out, err := exec.Command("git", "remote", "get-url", "origin").Output()
 	if err != nil {
 		return "", trace.Wrap(err)
 	}
-	if config.Host.Token == "" {
-		return "", trace.BadParameter("missing Github token.")
-	}
-	return config.Host.Token, nil
+	return strings.TrimSpace(string(out)), nil
 }
 
 // parseFlags parses flags and sets
@@ -142,6 +263,9 @@ func parseFlags() (err error) {
 	if *pr == 0 {
 		return trace.BadParameter("much supply pull request with changes to backport.")
 	}
+	if *parallel < 1 {
+		return trace.BadParameter("parallel must be at least 1.")
+	}
 	return nil
 }
 
@@ -159,8 +283,33 @@ func parseBranches(branchesInput string) ([]string, error) {
 	return backportBranches, nil
 }
 
-// generateTitleAndBody generates string that will be used 
-// to fill in the title and body fields for a pull request.
-func generateTitleAndBody(pullNumber int, targetBranch string) string {
-	return fmt.Sprintf("Backport #%s to %s", strconv.Itoa(pullNumber), targetBranch)
+// backportLabel is added to every backport pull request, in addition to any
+// labels carried over from the original pull request.
+const backportLabel = "backport"
+
+// pullRequestOptions builds the options for the backport pull request opened
+// onto targetBranch, carrying over the original pull request's title, body,
+// labels, assignees, reviewers, and milestone from meta.
+func pullRequestOptions(pullNumber int, targetBranch string, meta *provider.PullRequestMetadata) provider.PullRequestOptions {
+	return provider.PullRequestOptions{
+		Title:           fmt.Sprintf("[Backport %s] %s", targetBranch, meta.Title),
+		Body:            fmt.Sprintf("Backport of #%s.\n\n%s", strconv.Itoa(pullNumber), quoteBody(meta.Body)),
+		Labels:          append(append([]string{}, meta.Labels...), backportLabel),
+		Assignees:       meta.Assignees,
+		Reviewers:       meta.Reviewers,
+		MilestoneNumber: meta.MilestoneNumber,
+	}
+}
+
+// quoteBody quotes the original pull request's description as a Markdown
+// blockquote.
+func quoteBody(body string) string {
+	if body == "" {
+		return ""
+	}
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		lines[i] = "> " + line
+	}
+	return strings.Join(lines, "\n")
 }
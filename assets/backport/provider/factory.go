@@ -0,0 +1,88 @@
+/*
+Copyright 2022 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/gravitational/trace"
+
+	"github.com/teleport/assets/backport/azuredevops"
+	"github.com/teleport/assets/backport/bitbucket"
+	"github.com/teleport/assets/backport/github"
+	"github.com/teleport/assets/backport/gitlab"
+)
+
+// remotePatterns maps a Name to patterns that match the hostnames/paths
+// typically found in that forge's remote URL, used by DetectName.
+var remotePatterns = map[Name]*regexp.Regexp{
+	GitHub:          regexp.MustCompile(`github\.com`),
+	GitLab:          regexp.MustCompile(`gitlab\.`),
+	BitbucketServer: regexp.MustCompile(`(?i)bitbucket|stash`),
+	AzureDevOps:     regexp.MustCompile(`(?i)dev\.azure\.com|visualstudio\.com`),
+}
+
+// DetectName guesses the forge a repository is hosted on from its remote
+// URL, e.g. "git@gitlab.example.com:group/repo.git" or
+// "https://dev.azure.com/org/project/_git/repo".
+func DetectName(remoteURL string) (Name, error) {
+	for name, pattern := range remotePatterns {
+		if pattern.MatchString(remoteURL) {
+			return name, nil
+		}
+	}
+	return "", trace.BadParameter("could not detect forge from remote URL %q, pass --provider explicitly", remoteURL)
+}
+
+// New returns the Provider implementation for name.
+func New(ctx context.Context, name Name, c *Config) (Provider, error) {
+	if err := c.Check(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	switch name {
+	case GitHub:
+		return github.New(ctx, &github.Config{
+			Token:        c.Token,
+			Organization: c.Organization,
+			Repository:   c.Repository,
+		})
+	case GitLab:
+		return gitlab.New(ctx, &gitlab.Config{
+			Token:        c.Token,
+			BaseURL:      c.BaseURL,
+			Organization: c.Organization,
+			Repository:   c.Repository,
+		})
+	case BitbucketServer:
+		return bitbucket.New(ctx, &bitbucket.Config{
+			Token:        c.Token,
+			BaseURL:      c.BaseURL,
+			Organization: c.Organization,
+			Repository:   c.Repository,
+		})
+	case AzureDevOps:
+		return azuredevops.New(ctx, &azuredevops.Config{
+			Token:        c.Token,
+			BaseURL:      c.BaseURL,
+			Organization: c.Organization,
+			Repository:   c.Repository,
+		})
+	default:
+		return nil, trace.BadParameter("unsupported provider %q", name)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2022 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package provider defines the interface the backport tool uses to talk to
+// the forge hosting a repository (GitHub, GitLab, Bitbucket Server, or Azure
+// DevOps) so the rest of the tool does not need to know which one it is
+// talking to.
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gravitational/trace"
+)
+
+// Name identifies a supported Git forge.
+type Name string
+
+const (
+	// GitHub is the github.com forge.
+	GitHub Name = "github"
+	// GitLab is the gitlab.com (or self-managed GitLab) forge.
+	GitLab Name = "gitlab"
+	// BitbucketServer is a self-managed Bitbucket Server/Data Center instance.
+	BitbucketServer Name = "bitbucket-server"
+	// AzureDevOps is Azure Repos.
+	AzureDevOps Name = "azuredevops"
+)
+
+// Config holds the configuration shared by every provider implementation.
+type Config struct {
+	// Token is the credential used to authenticate to the forge's API.
+	Token string
+	// BaseURL is the API base URL. For GitLab, empty means gitlab.com; it is
+	// required for Bitbucket Server and Azure DevOps. The GitHub provider
+	// does not use it and always talks to github.com.
+	BaseURL string
+	// Organization is the GitHub org, GitLab group/namespace, Bitbucket
+	// Server project key, or Azure DevOps project, depending on the forge.
+	Organization string
+	// Repository is the repository name.
+	Repository string
+}
+
+// Check validates the config.
+func (c *Config) Check() error {
+	if c.Token == "" {
+		return trace.BadParameter("missing token")
+	}
+	if c.Organization == "" {
+		return trace.BadParameter("missing organization")
+	}
+	if c.Repository == "" {
+		return trace.BadParameter("missing repository")
+	}
+	return nil
+}
+
+// Provider backports changes from a closed pull/merge request onto release
+// branches on a specific Git forge.
+type Provider interface {
+	// GetPullRequestMetadata gets the metadata needed to backport the
+	// pull/merge request associated with the passed in number.
+	GetPullRequestMetadata(ctx context.Context, number int) (*PullRequestMetadata, error)
+
+	// CreateBranchFrom creates a branch named newBranchName from the HEAD of
+	// branchFromName.
+	CreateBranchFrom(ctx context.Context, branchFromName, newBranchName string) error
+
+	// CherryPick cherry-picks commits, in order, onto branchName. mainline
+	// selects which parent of a merge commit to diff against, matching
+	// `git cherry-pick -m`; it should be 0 when none of commits is a merge
+	// commit. GitLab, Bitbucket Server, and Azure DevOps reject any non-zero
+	// mainline.
+	CherryPick(ctx context.Context, branchName string, commits []string, mainline int) error
+
+	// Backport creates a new branch off of baseBranchName and cherry-picks
+	// commits onto it, returning the name of the new branch. See CherryPick
+	// for the meaning of mainline.
+	Backport(ctx context.Context, baseBranchName, backportBranchName string, commits []string, mainline int) (string, error)
+
+	// CreatePullRequest opens a pull/merge request from headBranch onto
+	// baseBranch, returning its URL.
+	CreatePullRequest(ctx context.Context, baseBranch, headBranch string, opts PullRequestOptions) (string, error)
+
+	// CreateConflictPullRequest opens a draft pull/merge request from
+	// headBranch onto baseBranch reporting a cherry-pick conflict, so a
+	// maintainer can pull down headBranch and resolve it locally. prNumber
+	// is the original pull/merge request number being backported. It
+	// returns the URL of the opened pull/merge request.
+	CreateConflictPullRequest(ctx context.Context, baseBranch, headBranch string, prNumber int, conflict *ConflictError) (string, error)
+}
+
+// PullRequestMetadata describes the original pull/merge request being
+// backported, so the generated backport PR can preserve its shape instead of
+// being a bare, unlabeled "Backport #N to branch".
+type PullRequestMetadata struct {
+	// Commits are the commit SHAs to cherry-pick, in order. If the original
+	// pull/merge request was merged via a merge commit, this is that single
+	// SHA and Mainline selects which parent to diff it against.
+	Commits []string
+	// Mainline is the `git cherry-pick -m` parent index to use when Commits
+	// is a single merge commit; 0 otherwise.
+	Mainline int
+	// BranchName is the original pull/merge request's head branch name.
+	BranchName string
+	// Title is the original pull/merge request's title.
+	Title string
+	// Body is the original pull/merge request's description.
+	Body string
+	// Labels are the original pull/merge request's labels.
+	Labels []string
+	// Assignees are the original pull/merge request's assignees' usernames.
+	Assignees []string
+	// Reviewers are the original pull/merge request's requested reviewers'
+	// usernames.
+	Reviewers []string
+	// MilestoneNumber is the original pull/merge request's milestone number,
+	// or 0 if it has none.
+	MilestoneNumber int
+}
+
+// PullRequestOptions configures a pull/merge request opened by
+// CreatePullRequest.
+type PullRequestOptions struct {
+	// Title is the pull/merge request title.
+	Title string
+	// Body is the pull/merge request description.
+	Body string
+	// Labels are applied to the pull/merge request.
+	Labels []string
+	// Assignees are set on the pull/merge request.
+	Assignees []string
+	// Reviewers are requested on the pull/merge request.
+	Reviewers []string
+	// MilestoneNumber is set on the pull/merge request, or 0 to leave it
+	// unset.
+	MilestoneNumber int
+}
+
+// ConflictError is returned by CherryPick when a commit could not be
+// cherry-picked cleanly. The target branch is left in place, with the
+// commits before the conflicting one already applied, so the conflict can be
+// resolved locally instead of redone from scratch.
+type ConflictError struct {
+	// SHA is the commit that failed to cherry-pick.
+	SHA string
+	// Files are the paths the failing commit touched, as reported by the
+	// forge. Not all of them necessarily collide.
+	Files []string
+}
+
+// Error implements error.
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("conflict cherry-picking %s: %d file(s) touched", e.SHA, len(e.Files))
+}
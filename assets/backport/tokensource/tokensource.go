@@ -0,0 +1,176 @@
+/*
+Copyright 2022 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tokensource resolves forge API credentials from whichever place
+// the contributor keeps them, so the backport tool never requires a token
+// to be pasted on the command line.
+package tokensource
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/gravitational/trace"
+	"github.com/zalando/go-keyring"
+	"gopkg.in/yaml.v2"
+)
+
+// TokenSource returns a forge API token.
+type TokenSource interface {
+	// Name is a human-readable identifier used in error messages, e.g.
+	// "gh CLI config".
+	Name() string
+	// Token returns the token, or an error if this source has none.
+	Token() (string, error)
+}
+
+// Resolve tries each source in order and returns the first token found.
+// It is used to implement the "try the forge's CLI config, then an env var,
+// then the system keyring" fallback chain.
+func Resolve(sources ...TokenSource) (string, error) {
+	var errs []error
+	for _, source := range sources {
+		token, err := source.Token()
+		if err != nil {
+			errs = append(errs, trace.Wrap(err, "%s", source.Name()))
+			continue
+		}
+		if token != "" {
+			return token, nil
+		}
+	}
+	return "", trace.NewAggregate(errs...)
+}
+
+// ghCLIConfig mirrors the parts of ~/.config/gh/hosts.yml this tool reads.
+type ghCLIConfig struct {
+	Hosts map[string]struct {
+		OAuthToken string `yaml:"oauth_token"`
+	} `yaml:",inline"`
+}
+
+// GHCLI reads the token the GitHub CLI (`gh auth login`) stored for host.
+type GHCLI struct {
+	// Host is the GitHub host the token was issued for, e.g. "github.com".
+	Host string
+}
+
+// Name implements TokenSource.
+func (g GHCLI) Name() string { return "gh CLI config" }
+
+// Token implements TokenSource.
+func (g GHCLI) Token() (string, error) {
+	return readYAMLHostToken(filepath.Join(".config", "gh", "hosts.yml"), g.Host)
+}
+
+// glabCLIConfig mirrors the parts of ~/.config/glab-cli/config.yml this tool reads.
+type glabCLIConfig struct {
+	Hosts map[string]struct {
+		Token string `yaml:"token"`
+	} `yaml:"hosts"`
+}
+
+// GlabCLI reads the token the GitLab CLI (`glab auth login`) stored for host.
+type GlabCLI struct {
+	// Host is the GitLab host the token was issued for, e.g. "gitlab.com".
+	Host string
+}
+
+// Name implements TokenSource.
+func (g GlabCLI) Name() string { return "glab CLI config" }
+
+// Token implements TokenSource.
+func (g GlabCLI) Token() (string, error) {
+	dirname, err := os.UserHomeDir()
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	path := filepath.Join(dirname, ".config", "glab-cli", "config.yml")
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	var config glabCLIConfig
+	if err := yaml.Unmarshal(raw, &config); err != nil {
+		return "", trace.Wrap(err)
+	}
+	return config.Hosts[g.Host].Token, nil
+}
+
+// Env reads the token from an environment variable, e.g. GITHUB_TOKEN,
+// GITLAB_TOKEN, BITBUCKET_TOKEN, AZURE_DEVOPS_TOKEN.
+type Env struct {
+	// Var is the environment variable name.
+	Var string
+}
+
+// Name implements TokenSource.
+func (e Env) Name() string { return e.Var }
+
+// Token implements TokenSource.
+func (e Env) Token() (string, error) {
+	return os.Getenv(e.Var), nil
+}
+
+// Keyring reads the token from the OS-native credential store (macOS
+// Keychain, Secret Service on Linux, Windows Credential Manager).
+type Keyring struct {
+	// Service is the keyring service name the token was stored under.
+	Service string
+	// User identifies the credential within Service, e.g. "github.com".
+	User string
+}
+
+// Name implements TokenSource.
+func (k Keyring) Name() string { return "system keyring" }
+
+// Token implements TokenSource.
+func (k Keyring) Token() (string, error) {
+	token, err := keyring.Get(k.Service, k.User)
+	if err == keyring.ErrNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	return token, nil
+}
+
+// readYAMLHostToken reads a gh-CLI-style "hosts.yml" file relative to the
+// user's home directory and returns the oauth_token for host.
+func readYAMLHostToken(relPath string, host string) (string, error) {
+	dirname, err := os.UserHomeDir()
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	path := filepath.Join(dirname, relPath)
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	var config ghCLIConfig
+	if err := yaml.Unmarshal(raw, &config); err != nil {
+		return "", trace.Wrap(err)
+	}
+	return config.Hosts[host].OAuthToken, nil
+}